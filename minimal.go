@@ -1,67 +1,2397 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // User 用户结构体
 type User struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
+	// Version 创建时为 1，每次修改加 1，用于 UpdateUser 的乐观并发检查
+	Version int `json:"version"`
+}
+
+// Storage 用户数据存储
+type Storage interface {
+	// Save 用给定用户整体替换存储内容
+	Save(users []User) error
+	// Load 读取全部用户，存储为空时返回空切片
+	Load() ([]User, error)
+	// Put 新增或覆盖单个用户
+	Put(user User) error
+	// Get 读取单个用户，不存在时 ok 为 false
+	Get(id int) (user User, ok bool, err error)
+	// Delete 删除单个用户，不存在时不报错
+	Delete(id int) error
+	// SaveMeta 保存管理器元数据
+	SaveMeta(meta Meta) error
+	// LoadMeta 读取管理器元数据，从未保存过时返回零值
+	LoadMeta() (Meta, error)
+}
+
+// Meta 需要随用户数据一起持久化的管理器状态
+type Meta struct {
+	// NextID 下一个自增ID，重启后不会再分配小于它的ID
+	NextID int `json:"next_id"`
+	// Reserved 已预留但尚未使用的ID
+	Reserved []int `json:"reserved,omitempty"`
+	// Trash 回收站中的用户，按ID排序
+	Trash []TrashedUser `json:"trash,omitempty"`
+}
+
+// FileStorage 文本文件存储，文件以 fileHeader 开头，之后每行一个 "ID,版本号,姓名"，
+// 元数据以 JSON 保存在 path+".meta"。含换行或以双引号开头的姓名按 Go 字符串字面量
+// 加引号保存。也能读取旧格式：fileHeaderV2 开头的文件每行为 "ID,姓名"；没有格式标记
+// 的最早格式每行也是 "ID,姓名"，但姓名原样读取。旧格式中的用户版本号视为 1。
+type FileStorage struct {
+	mu   sync.Mutex
+	path string
+}
+
+const (
+	// fileHeader 当前的文件格式标记，数据行以数字ID开头，不会与之混淆
+	fileHeader = "# users v3"
+	// fileHeaderV2 不含版本号的旧格式标记
+	fileHeaderV2 = "# users v2"
+)
+
+// NewFileStorage 创建文件存储
+func NewFileStorage(path string) *FileStorage {
+	return &FileStorage{path: path}
+}
+
+// Save 按ID顺序写入文件
+func (s *FileStorage) Save(users []User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(users)
+}
+
+// Load 读取文件，文件不存在时返回空切片
+func (s *FileStorage) Load() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// Put 新增或覆盖单个用户
+func (s *FileStorage) Put(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, err := s.read()
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		if users[i].ID == user.ID {
+			users[i] = user
+			return s.write(users)
+		}
+	}
+	return s.write(append(users, user))
+}
+
+// Get 读取单个用户
+func (s *FileStorage) Get(id int) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, err := s.read()
+	if err != nil {
+		return User{}, false, err
+	}
+	for _, user := range users {
+		if user.ID == id {
+			return user, true, nil
+		}
+	}
+	return User{}, false, nil
+}
+
+// Delete 删除单个用户
+func (s *FileStorage) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, err := s.read()
+	if err != nil {
+		return err
+	}
+	kept := users[:0]
+	for _, user := range users {
+		if user.ID != id {
+			kept = append(kept, user)
+		}
+	}
+	return s.write(kept)
+}
+
+// SaveMeta 写入元数据文件
+func (s *FileStorage) SaveMeta(meta Meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path+".meta", append(data, '\n'), 0644)
+}
+
+// LoadMeta 读取元数据文件，文件不存在时返回零值
+func (s *FileStorage) LoadMeta() (Meta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var meta Meta
+	data, err := ioutil.ReadFile(s.path + ".meta")
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("%s.meta 解析失败: %v", s.path, err)
+	}
+	return meta, nil
+}
+
+// read 解析文件内容，调用方需持有锁
+func (s *FileStorage) read() ([]User, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return []User{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	lines := strings.Split(string(data), "\n")
+	versioned := lines[0] == fileHeader
+	quoted := versioned || lines[0] == fileHeaderV2
+	fields := 2
+	if versioned {
+		fields = 3
+	}
+	for n, line := range lines {
+		if line == "" || (n == 0 && quoted) {
+			continue
+		}
+		parts := strings.SplitN(line, ",", fields)
+		if len(parts) != fields {
+			return nil, fmt.Errorf("%s 第%d行格式错误: %q", s.path, n+1, line)
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s 第%d行ID无效: %q", s.path, n+1, parts[0])
+		}
+		version := 1
+		if versioned {
+			if version, err = strconv.Atoi(parts[1]); err != nil {
+				return nil, fmt.Errorf("%s 第%d行版本号无效: %q", s.path, n+1, parts[1])
+			}
+		}
+		name := parts[fields-1]
+		if quoted {
+			name = decodeName(name)
+		}
+		users = append(users, User{ID: id, Name: name, Version: version})
+	}
+	return users, nil
+}
+
+// write 按ID顺序写入文件，调用方需持有锁
+func (s *FileStorage) write(users []User) error {
+	sorted := append([]User(nil), users...)
+	sortUsersByID(sorted)
+	data := fileHeader + "\n"
+	for _, user := range sorted {
+		data += fmt.Sprintf("%d,%d,%s\n", user.ID, user.Version, encodeName(user.Name))
+	}
+	return ioutil.WriteFile(s.path, []byte(data), 0644)
+}
+
+// encodeName 姓名会破坏行格式时加引号，其余姓名原样保存
+func encodeName(name string) string {
+	if strings.ContainsAny(name, "\r\n") || strings.HasPrefix(name, `"`) {
+		return strconv.Quote(name)
+	}
+	return name
+}
+
+// decodeName 还原 encodeName 保存的姓名
+func decodeName(raw string) string {
+	if strings.HasPrefix(raw, `"`) {
+		if name, err := strconv.Unquote(raw); err == nil {
+			return name
+		}
+	}
+	return raw
+}
+
+// MemoryStorage 内存存储，不落盘
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	users map[int]User
+	meta  Meta
+}
+
+// NewMemoryStorage 创建内存存储
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{users: make(map[int]User)}
+}
+
+// Save 整体替换存储内容
+func (s *MemoryStorage) Save(users []User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[int]User, len(users))
+	for _, user := range users {
+		s.users[user.ID] = user
+	}
+	return nil
+}
+
+// Load 读取全部用户，按ID排序
+func (s *MemoryStorage) Load() ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	sortUsersByID(users)
+	return users, nil
+}
+
+// Put 新增或覆盖单个用户
+func (s *MemoryStorage) Put(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.ID] = user
+	return nil
+}
+
+// Get 读取单个用户
+func (s *MemoryStorage) Get(id int) (User, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[id]
+	return user, ok, nil
+}
+
+// Delete 删除单个用户
+func (s *MemoryStorage) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, id)
+	return nil
+}
+
+// SaveMeta 保存元数据
+func (s *MemoryStorage) SaveMeta(meta Meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.meta = copyMeta(meta)
+	return nil
+}
+
+// LoadMeta 读取元数据
+func (s *MemoryStorage) LoadMeta() (Meta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyMeta(s.meta), nil
+}
+
+// copyMeta 复制元数据，避免共享切片
+func copyMeta(meta Meta) Meta {
+	meta.Reserved = append([]int(nil), meta.Reserved...)
+	meta.Trash = append([]TrashedUser(nil), meta.Trash...)
+	return meta
+}
+
+// EventLogStorage 事件日志存储，只追加事件，读取时重放事件得到当前状态。
+// 文件每行是一个 JSON 编码的 logRecord。移入回收站记为带 deleted_at 的删除事件，
+// 彻底删除记为 UserPurged 事件，重放时据此重建回收站。
+type EventLogStorage struct {
+	mu     sync.Mutex
+	path   string
+	state  logState
+	loaded bool
+	// end 最后一个完整行之后的偏移，append 据此截掉不完整的末行
+	end int64
+}
+
+// recordMeta 元数据记录类型，只出现在事件日志中
+const recordMeta EventType = "Meta"
+
+// logRecord 事件日志中的一行，用户事件的格式与 Event 相同。
+// 元数据记录只包含 NextID 和 Reserved，回收站由用户事件表示。
+type logRecord struct {
+	Type      EventType  `json:"type"`
+	User      *User      `json:"user,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Meta      *Meta      `json:"meta,omitempty"`
+}
+
+// logState 重放事件得到的状态
+type logState struct {
+	users map[int]User
+	trash map[int]TrashedUser
+	meta  Meta
+}
+
+// NewEventLogStorage 创建事件日志存储
+func NewEventLogStorage(path string) *EventLogStorage {
+	return &EventLogStorage{path: path}
+}
+
+// Save 追加使存储与给定用户一致所需的事件，数据不变时不写入
+func (s *EventLogStorage) Save(users []User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(); err != nil {
+		return err
+	}
+	var records []logRecord
+	keep := make(map[int]bool, len(users))
+	for _, user := range users {
+		keep[user.ID] = true
+		if record, changed := s.putRecord(user); changed {
+			records = append(records, record)
+		}
+	}
+	for _, user := range s.sorted() {
+		if !keep[user.ID] {
+			records = append(records, userRecord(EventUserDeleted, user))
+		}
+	}
+	return s.append(records...)
+}
+
+// Load 重放事件，返回按ID排序的用户
+func (s *EventLogStorage) Load() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	return s.sorted(), nil
+}
+
+// Put 追加新增或修改事件
+func (s *EventLogStorage) Put(user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(); err != nil {
+		return err
+	}
+	record, changed := s.putRecord(user)
+	if !changed {
+		return nil
+	}
+	return s.append(record)
+}
+
+// Get 读取单个用户
+func (s *EventLogStorage) Get(id int) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(); err != nil {
+		return User{}, false, err
+	}
+	user, ok := s.state.users[id]
+	return user, ok, nil
+}
+
+// Delete 追加删除事件
+func (s *EventLogStorage) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(); err != nil {
+		return err
+	}
+	user, ok := s.state.users[id]
+	if !ok {
+		return nil
+	}
+	return s.append(userRecord(EventUserDeleted, user))
+}
+
+// SaveMeta 只追加变化的部分：新进入回收站的用户记为带 deleted_at 的删除事件，
+// 离开回收站的用户记为 UserPurged 事件，NextID 或 Reserved 变化时追加元数据记录
+func (s *EventLogStorage) SaveMeta(meta Meta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(); err != nil {
+		return err
+	}
+	var records []logRecord
+	inTrash := make(map[int]bool, len(meta.Trash))
+	for _, t := range meta.Trash {
+		inTrash[t.ID] = true
+		if old, ok := s.state.trash[t.ID]; ok && old.User == t.User && old.DeletedAt.Equal(t.DeletedAt) {
+			continue
+		}
+		record := userRecord(EventUserDeleted, t.User)
+		deletedAt := t.DeletedAt
+		record.DeletedAt = &deletedAt
+		records = append(records, record)
+	}
+	for _, t := range s.trashed() {
+		if !inTrash[t.ID] {
+			records = append(records, userRecord(EventUserPurged, t.User))
+		}
+	}
+	base := Meta{NextID: meta.NextID, Reserved: meta.Reserved}
+	if !reflect.DeepEqual(normalizeMeta(base), normalizeMeta(s.state.meta)) {
+		base = copyMeta(base)
+		records = append(records, logRecord{Type: recordMeta, Meta: &base})
+	}
+	return s.append(records...)
+}
+
+// LoadMeta 返回最后一条元数据记录和重建的回收站
+func (s *EventLogStorage) LoadMeta() (Meta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.replay(); err != nil {
+		return Meta{}, err
+	}
+	meta := copyMeta(s.state.meta)
+	meta.Trash = s.trashed()
+	return meta, nil
+}
+
+// userRecord 创建用户事件记录
+func userRecord(eventType EventType, user User) logRecord {
+	return logRecord{Type: eventType, User: &user}
+}
+
+// putRecord 生成写入用户对应的记录，用户未变化时 changed 为 false
+func (s *EventLogStorage) putRecord(user User) (record logRecord, changed bool) {
+	old, ok := s.state.users[user.ID]
+	switch {
+	case !ok:
+		return userRecord(EventUserCreated, user), true
+	case old != user:
+		return userRecord(EventUserUpdated, user), true
+	}
+	return logRecord{}, false
+}
+
+// replay 首次使用时从文件重放事件，调用方需持有锁。
+// 没有换行结尾的末行可能是中断的写入或正在进行的写入，读取时忽略，不修改文件。
+func (s *EventLogStorage) replay() error {
+	if s.loaded {
+		return nil
+	}
+	state := logState{users: make(map[int]User), trash: make(map[int]TrashedUser)}
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		s.state, s.loaded, s.end = state, true, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var offset int64
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var record logRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("%s 第%d行解析失败: %v", s.path, n, err)
+		}
+		if err := state.apply(record); err != nil {
+			return fmt.Errorf("%s 第%d行: %v", s.path, n, err)
+		}
+	}
+	s.state, s.loaded, s.end = state, true, offset
+	return nil
+}
+
+// append 写入记录并更新内存状态，调用方需持有锁。
+// 写入前截掉之前中断的写入留下的不完整末行，写入失败时将文件截回原长度。
+func (s *EventLogStorage) append(records ...logRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	state := s.state.clone()
+	data := []byte{}
+	for _, record := range records {
+		if err := state.apply(record); err != nil {
+			return err
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	size, err := s.dropTornLine(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Truncate(size)
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.state, s.end = state, size+int64(len(data))
+	return nil
+}
+
+// dropTornLine 文件不以换行结尾时截回最后一个完整行，返回截断后的长度
+func (s *EventLogStorage) dropTornLine(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return 0, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' || size <= s.end {
+		return size, nil
+	}
+	if err := f.Truncate(s.end); err != nil {
+		return 0, err
+	}
+	return s.end, nil
+}
+
+// sorted 返回按ID排序的当前用户，调用方需持有锁
+func (s *EventLogStorage) sorted() []User {
+	users := make([]User, 0, len(s.state.users))
+	for _, user := range s.state.users {
+		users = append(users, user)
+	}
+	sortUsersByID(users)
+	return users
+}
+
+// trashed 返回按ID排序的回收站用户，调用方需持有锁
+func (s *EventLogStorage) trashed() []TrashedUser {
+	trashed := make([]TrashedUser, 0, len(s.state.trash))
+	for _, t := range s.state.trash {
+		trashed = append(trashed, t)
+	}
+	sort.Slice(trashed, func(i, j int) bool {
+		return trashed[i].ID < trashed[j].ID
+	})
+	return trashed
+}
+
+// clone 复制状态，append 在副本上应用记录，写入成功后才替换
+func (st logState) clone() logState {
+	c := logState{
+		users: make(map[int]User, len(st.users)),
+		trash: make(map[int]TrashedUser, len(st.trash)),
+		meta:  copyMeta(st.meta),
+	}
+	for id, user := range st.users {
+		c.users[id] = user
+	}
+	for id, t := range st.trash {
+		c.trash[id] = t
+	}
+	return c
+}
+
+// apply 将记录应用到状态上
+func (st *logState) apply(record logRecord) error {
+	if record.Type == recordMeta {
+		if record.Meta == nil {
+			return errors.New("元数据记录为空")
+		}
+		st.meta = Meta{NextID: record.Meta.NextID, Reserved: append([]int(nil), record.Meta.Reserved...)}
+		return nil
+	}
+	if record.User == nil {
+		return fmt.Errorf("%s 事件缺少用户", record.Type)
+	}
+	user := *record.User
+	switch record.Type {
+	case EventUserCreated, EventUserUpdated:
+		st.users[user.ID] = user
+		delete(st.trash, user.ID)
+	case EventUserDeleted:
+		delete(st.users, user.ID)
+		if record.DeletedAt != nil {
+			st.trash[user.ID] = TrashedUser{User: user, DeletedAt: *record.DeletedAt}
+		}
+	case EventUserPurged:
+		delete(st.trash, user.ID)
+	default:
+		return fmt.Errorf("未知事件类型: %q", record.Type)
+	}
+	return nil
+}
+
+// normalizeMeta 将空切片统一为 nil，便于比较
+func normalizeMeta(meta Meta) Meta {
+	if len(meta.Reserved) == 0 {
+		meta.Reserved = nil
+	}
+	return meta
+}
+
+// sortUsersByID 按ID升序排序
+func sortUsersByID(users []User) {
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+}
+
+// EventType 事件类型
+type EventType string
+
+const (
+	// EventUserCreated 用户已创建
+	EventUserCreated EventType = "UserCreated"
+	// EventUserUpdated 用户已修改
+	EventUserUpdated EventType = "UserUpdated"
+	// EventUserDeleted 用户已删除
+	EventUserDeleted EventType = "UserDeleted"
+	// EventUserRestored 用户已从回收站恢复
+	EventUserRestored EventType = "UserRestored"
+	// EventUserPurged 用户已从回收站彻底删除
+	EventUserPurged EventType = "UserPurged"
+)
+
+// Event 用户变更事件，Seq 按修改生效的顺序从 1 递增。
+// User 为变更后的用户，删除事件中为被删除的用户；Old 只在修改事件中出现。
+type Event struct {
+	Seq  uint64    `json:"seq"`
+	Type EventType `json:"type"`
+	User User      `json:"user"`
+	Old  *User     `json:"old,omitempty"`
+	At   time.Time `json:"at"`
+}
+
+// subscriber 事件订阅者，事件先进入无界队列，再由独立的 goroutine 写入通道
+type subscriber struct {
+	ch   chan Event
+	done chan struct{}
+	wake chan struct{}
+
+	mu    sync.Mutex
+	queue []Event
+}
+
+// enqueue 将事件加入队列，不会阻塞
+func (sub *subscriber) enqueue(event Event) {
+	sub.mu.Lock()
+	sub.queue = append(sub.queue, event)
+	sub.mu.Unlock()
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run 按顺序把队列中的事件写入通道，退订后关闭通道
+func (sub *subscriber) run() {
+	defer close(sub.ch)
+	for {
+		sub.mu.Lock()
+		if len(sub.queue) == 0 {
+			sub.mu.Unlock()
+			select {
+			case <-sub.wake:
+				continue
+			case <-sub.done:
+				return
+			}
+		}
+		event := sub.queue[0]
+		sub.queue[0] = Event{}
+		sub.queue = sub.queue[1:]
+		sub.mu.Unlock()
+
+		select {
+		case sub.ch <- event:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// WebhookDelivery 一次事件推送的结果
+type WebhookDelivery struct {
+	Event     Event     `json:"event"`
+	Attempts  int       `json:"attempts"`
+	Delivered bool      `json:"delivered"`
+	LastError string    `json:"last_error,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+const (
+	// maxWebhookDeliveries 每个 Webhook 保留的最近推送记录数
+	maxWebhookDeliveries = 100
+	// maxWebhookQueue 每个 Webhook 待推送事件的上限，超出的事件被丢弃并记录
+	maxWebhookQueue = 1000
+)
+
+// Webhook 将用户事件以签名的 JSON POST 推送到指定 URL。
+// 请求头 X-Signature-256 为 "sha256=" 加上请求体的 HMAC-SHA256 十六进制值。
+type Webhook struct {
+	URL string
+
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	baseDelay   time.Duration
+	unsubscribe func()
+	queue       chan Event
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	mu         sync.Mutex
+	deliveries []WebhookDelivery
+}
+
+// AddWebhook 注册 Webhook，之后的每个用户事件都会推送到 rawURL，
+// rawURL 必须是 http 或 https 的绝对地址。
+// 网络错误、5xx、408 和 429 按指数退避重试，其余 4xx 视为永久失败不再重试。
+// 同一 Webhook 的事件按顺序推送。推送在后台进行，接收方不可用时不会拖慢
+// 修改操作：待推送事件超过 maxWebhookQueue 时新事件被丢弃，并在推送记录中
+// 标记为失败。
+func (m *MinimalManager) AddWebhook(rawURL, secret string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Webhook 地址无效: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Webhook 地址必须是 http 或 https 的绝对地址: %q", rawURL)
+	}
+	events, unsubscribe := m.Subscribe(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Webhook{
+		URL:         u.String(),
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 5,
+		baseDelay:   500 * time.Millisecond,
+		unsubscribe: unsubscribe,
+		queue:       make(chan Event, maxWebhookQueue),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	go func() {
+		for event := range events {
+			select {
+			case w.queue <- event:
+			default:
+				w.record(WebhookDelivery{Event: event, LastError: "推送队列已满，事件被丢弃", At: time.Now()})
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case event := <-w.queue:
+				w.record(w.deliver(event))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+// Close 停止推送，正在进行的请求和重试会被取消，未推送的事件被丢弃
+func (w *Webhook) Close() {
+	w.unsubscribe()
+	w.cancel()
+}
+
+// Deliveries 返回最近的推送记录，按时间顺序
+func (w *Webhook) Deliveries() []WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WebhookDelivery(nil), w.deliveries...)
+}
+
+// deliver 推送单个事件，失败时重试
+func (w *Webhook) deliver(event Event) WebhookDelivery {
+	delivery := WebhookDelivery{Event: event}
+	body, err := json.Marshal(event)
+	if err != nil {
+		delivery.LastError = err.Error()
+		delivery.At = time.Now()
+		return delivery
+	}
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	delay := w.baseDelay
+	for delivery.Attempts < w.maxAttempts {
+		if delivery.Attempts > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-w.ctx.Done():
+				timer.Stop()
+				delivery.LastError = w.ctx.Err().Error()
+				delivery.At = time.Now()
+				return delivery
+			}
+			delay *= 2
+		}
+		delivery.Attempts++
+		err := w.post(body, signature)
+		delivery.At = time.Now()
+		if err == nil {
+			delivery.Delivered = true
+			delivery.LastError = ""
+			return delivery
+		}
+		delivery.LastError = err.Error()
+		if !retryable(err) {
+			return delivery
+		}
+	}
+	return delivery
+}
+
+// statusError 接收方返回的非 2xx 响应
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "响应状态异常: " + e.status
+}
+
+// retryable 判断推送失败后是否值得重试，4xx 中只有 408 和 429 是暂时性的
+func retryable(err error) bool {
+	se, ok := err.(*statusError)
+	if !ok || se.code < 400 || se.code >= 500 {
+		return true
+	}
+	return se.code == http.StatusRequestTimeout || se.code == http.StatusTooManyRequests
+}
+
+// post 发送一次请求，非 2xx 响应视为失败
+func (w *Webhook) post(body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-256", signature)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// record 保存推送记录，只保留最近的 maxWebhookDeliveries 条
+func (w *Webhook) record(delivery WebhookDelivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.deliveries = append(w.deliveries, delivery)
+	if n := len(w.deliveries) - maxWebhookDeliveries; n > 0 {
+		w.deliveries = append(w.deliveries[:0], w.deliveries[n:]...)
+	}
+}
+
+// AuditRecord 审计日志中的一条记录，Actor 为操作者
+type AuditRecord struct {
+	Event
+	Actor string `json:"actor,omitempty"`
+}
+
+// AuditFilter 审计记录的筛选条件，零值字段不参与筛选，时间范围为 [Since, Until)
+type AuditFilter struct {
+	UserID int
+	Type   EventType
+	Since  time.Time
+	Until  time.Time
+}
+
+// match 判断记录是否满足筛选条件
+func (f AuditFilter) match(record AuditRecord) bool {
+	switch {
+	case f.UserID != 0 && record.User.ID != f.UserID:
+		return false
+	case f.Type != "" && record.Type != f.Type:
+		return false
+	case !f.Since.IsZero() && record.At.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !record.At.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// AuditLog 将用户事件以 JSON Lines 追加到审计文件，记录跨重启保留。
+// Seq 只在同一进程内递增，跨重启的先后以 At 为准。
+type AuditLog struct {
+	path        string
+	actor       string
+	m           *MinimalManager
+	unsubscribe func()
+	done        chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written uint64
+	stopped bool
+	err     error
+}
+
+// AddAuditLog 把之后的每个用户事件追加到 path，actor 作为每条记录的操作者，
+// 如运行程序的系统用户
+func (m *MinimalManager) AddAuditLog(path, actor string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{path: path, actor: actor, m: m, done: make(chan struct{})}
+	a.cond = sync.NewCond(&a.mu)
+	// 持读锁订阅，期间没有新事件，written 即为订阅前最后一个事件的序号
+	m.mu.RLock()
+	a.written = m.eventSeq
+	events, unsubscribe := m.Subscribe(0)
+	m.mu.RUnlock()
+	a.unsubscribe = unsubscribe
+	go a.run(f, events)
+	return a, nil
+}
+
+// run 按顺序写入事件，退订后关闭文件
+func (a *AuditLog) run(f *os.File, events <-chan Event) {
+	defer close(a.done)
+	for event := range events {
+		line, err := json.Marshal(AuditRecord{Event: event, Actor: a.actor})
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+		}
+		a.mu.Lock()
+		if err != nil && a.err == nil {
+			a.err = err
+		}
+		a.written = event.Seq
+		a.cond.Broadcast()
+		a.mu.Unlock()
+	}
+	err := f.Close()
+	a.mu.Lock()
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+	a.stopped = true
+	a.cond.Broadcast()
+	a.mu.Unlock()
+}
+
+// flush 等待调用前发生的事件全部写入，返回第一个写入错误
+func (a *AuditLog) flush() error {
+	a.m.mu.RLock()
+	target := a.m.eventSeq
+	a.m.mu.RUnlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.written < target && !a.stopped {
+		a.cond.Wait()
+	}
+	return a.err
+}
+
+// Close 写完已发生的事件后停止记录，返回写入过程中的第一个错误
+func (a *AuditLog) Close() error {
+	a.flush()
+	a.unsubscribe()
+	<-a.done
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// ListAuditEvents 返回审计文件中满足 filter 的记录，按写入顺序。
+// 调用前发生的事件都会包含在内，不完整的末行被忽略。
+func (a *AuditLog) ListAuditEvents(filter AuditFilter) ([]AuditRecord, error) {
+	if err := a.flush(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []AuditRecord
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("%s 第%d行解析失败: %v", a.path, n, err)
+		}
+		if filter.match(record) {
+			records = append(records, record)
+		}
+	}
+}
+
+// Option 管理器配置项
+type Option func(*MinimalManager)
+
+// WithFilename 使用指定路径的文件存储
+func WithFilename(filename string) Option {
+	return func(m *MinimalManager) {
+		m.storage = NewFileStorage(filename)
+	}
+}
+
+// WithStorage 设置存储后端
+func WithStorage(storage Storage) Option {
+	return func(m *MinimalManager) {
+		m.storage = storage
+	}
+}
+
+// WithOutput 设置显示输出位置
+func WithOutput(w io.Writer) Option {
+	return func(m *MinimalManager) {
+		m.out = w
+	}
+}
+
+// WithIDGenerator 设置ID生成函数
+func WithIDGenerator(gen func() int) Option {
+	return func(m *MinimalManager) {
+		m.newID = gen
+	}
+}
+
+// WithValidator 设置用户名校验函数
+func WithValidator(validate func(name string) error) Option {
+	return func(m *MinimalManager) {
+		m.validate = validate
+	}
+}
+
+// WithAutoSave 设置添加、修改、删除用户后是否立即写入存储
+func WithAutoSave(autoSave bool) Option {
+	return func(m *MinimalManager) {
+		m.autoSave = autoSave
+	}
+}
+
+// WithIDFormat 设置ID的显示格式：前缀加补零到 width 位的数字，
+// 如 WithIDFormat("USR-", 6) 显示为 "USR-000123"，width 不大于 0 时不补零，
+// 存储仍使用数字ID
+func WithIDFormat(prefix string, width int) Option {
+	return func(m *MinimalManager) {
+		if width < 0 {
+			width = 0
+		}
+		m.idPrefix = prefix
+		m.idWidth = width
+	}
+}
+
+// WithTrashRetention 设置回收站保留时长，超时的用户在下次操作回收站时被彻底删除，
+// 0 表示永久保留
+func WithTrashRetention(d time.Duration) Option {
+	return func(m *MinimalManager) {
+		m.trashRetention = d
+	}
+}
+
+// TrashedUser 回收站中的用户
+type TrashedUser struct {
+	User
+	DeletedAt time.Time `json:"deleted_at"`
 }
 
 // MinimalManager 最小化管理器
+//
+// 所有方法都可以被多个 goroutine 并发调用。ID生成函数和校验函数在持有锁时
+// 调用，不能再回调管理器的方法。
 type MinimalManager struct {
-	users  map[int]User
-	nextID int
+	mu         sync.RWMutex
+	users      map[int]User
+	nextID     int
+	storage    Storage
+	out        io.Writer
+	newID      func() int
+	validate   func(name string) error
+	autoSave   bool
+	reserved   map[int]bool
+	idPrefix   string
+	idWidth    int
+	onAdded    []func(User)
+	onUpdated  []func(old, new User)
+	onDeleted  []func(User)
+	onRestored []func(User)
+	onPurged   []func(User)
+
+	trash          map[int]TrashedUser
+	trashRetention time.Duration
+	history        map[int][]UserVersion
+
+	eventSeq uint64
+	subMu    sync.RWMutex
+	subs     map[*subscriber]struct{}
+}
+
+// NewMinimalManager 创建管理器
+func NewMinimalManager(opts ...Option) *MinimalManager {
+	m := &MinimalManager{
+		users:    make(map[int]User),
+		reserved: make(map[int]bool),
+		trash:    make(map[int]TrashedUser),
+		history:  make(map[int][]UserVersion),
+		subs:     make(map[*subscriber]struct{}),
+		nextID:   1,
+		storage:  NewFileStorage("users.txt"),
+		out:      os.Stdout,
+	}
+	m.newID = m.sequentialID
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// sequentialID 默认的自增ID
+func (m *MinimalManager) sequentialID() int {
+	id := m.nextID
+	m.nextID++
+	return id
+}
+
+// AddUser 添加用户，返回创建的用户
+func (m *MinimalManager) AddUser(name string) (User, error) {
+	user, added, err := m.addUser(name)
+	if added {
+		m.userAdded(user)
+	}
+	return user, err
+}
+
+// BulkFailure 批量添加中失败的单项
+type BulkFailure struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// BulkResult 批量添加结果
+type BulkResult struct {
+	Created []User        `json:"created"`
+	Failed  []BulkFailure `json:"failed"`
+	// SaveFailed 已添加到内存但自动保存失败的用户，这些用户同时出现在 Created 中
+	SaveFailed []BulkFailure `json:"save_failed"`
+}
+
+// AddUsers 批量添加用户，每项独立成功或失败。有失败项时返回汇总错误，
+// 详细信息见 BulkResult.Failed 和 BulkResult.SaveFailed。
+func (m *MinimalManager) AddUsers(names []string) (BulkResult, error) {
+	var result BulkResult
+	for i, name := range names {
+		user, added, err := m.addUser(name)
+		if !added {
+			result.Failed = append(result.Failed, BulkFailure{Index: i, Name: name, Error: err.Error()})
+			continue
+		}
+		m.userAdded(user)
+		result.Created = append(result.Created, user)
+		if err != nil {
+			result.SaveFailed = append(result.SaveFailed, BulkFailure{Index: i, Name: name, Error: err.Error()})
+		}
+	}
+	switch {
+	case len(result.Failed) > 0 && len(result.SaveFailed) > 0:
+		return result, fmt.Errorf("%d/%d 个用户添加失败，%d 个用户保存失败",
+			len(result.Failed), len(names), len(result.SaveFailed))
+	case len(result.Failed) > 0:
+		return result, fmt.Errorf("%d/%d 个用户添加失败", len(result.Failed), len(names))
+	case len(result.SaveFailed) > 0:
+		return result, fmt.Errorf("%d/%d 个用户已添加但保存失败", len(result.SaveFailed), len(names))
+	}
+	return result, nil
+}
+
+// addUser 持锁添加用户，added 表示用户是否已写入内存
+func (m *MinimalManager) addUser(name string) (user User, added bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.validateName(name); err != nil {
+		return User{}, false, err
+	}
+	id := m.newID()
+	if m.idTaken(id) {
+		return User{}, false, fmt.Errorf("用户ID已存在: %d", id)
+	}
+	user, err = m.insert(User{ID: id, Name: name, Version: 1})
+	m.recordVersion(user)
+	m.publish(EventUserCreated, user)
+	return user, true, err
+}
+
+// ReserveID 预留一个ID，供之后 AddUserWithID 使用。
+// 预留随 SaveToFile 持久化，开启自动保存时立即持久化，LoadFromFile 后仍然有效。
+// 自动保存失败时撤销预留并返回错误。
+func (m *MinimalManager) ReserveID() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.newID()
+	if m.idTaken(id) {
+		return 0, fmt.Errorf("用户ID已存在: %d", id)
+	}
+	m.reserved[id] = true
+	if m.autoSave {
+		if err := m.storage.SaveMeta(m.meta()); err != nil {
+			delete(m.reserved, id)
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// AddUserWithID 使用预留的ID添加用户，返回创建的用户
+func (m *MinimalManager) AddUserWithID(id int, name string) (User, error) {
+	user, added, err := m.addUserWithID(id, name)
+	if added {
+		m.userAdded(user)
+	}
+	return user, err
+}
+
+// addUserWithID 持锁使用预留ID添加用户
+func (m *MinimalManager) addUserWithID(id int, name string) (user User, added bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.reserved[id] {
+		return User{}, false, fmt.Errorf("ID未预留: %d", id)
+	}
+	if err := m.validateName(name); err != nil {
+		return User{}, false, err
+	}
+	delete(m.reserved, id)
+	user, err = m.insert(User{ID: id, Name: name, Version: 1})
+	m.recordVersion(user)
+	m.publish(EventUserCreated, user)
+	if err == nil && m.autoSave {
+		err = m.storage.SaveMeta(m.meta())
+	}
+	return user, true, err
 }
 
-// NewMinimalManager 创建管理器
-func NewMinimalManager() *MinimalManager {
-	return &MinimalManager{
-		users:  make(map[int]User),
-		nextID: 1,
+// validateName 使用配置的校验函数检查用户名
+func (m *MinimalManager) validateName(name string) error {
+	if m.validate == nil {
+		return nil
 	}
+	return m.validate(name)
 }
 
-// AddUser 添加用户
-func (m *MinimalManager) AddUser(name string) {
-	user := User{ID: m.nextID, Name: name}
-	m.users[m.nextID] = user
-	m.nextID++
+// PolicyViolation 不满足校验规则的现有用户
+type PolicyViolation struct {
+	User  User   `json:"user"`
+	Error string `json:"error"`
 }
 
-// ShowUsers 显示所有用户
-func (m *MinimalManager) ShowUsers() {
-	fmt.Println("用户列表:")
+// SimulateValidator 用新的校验函数检查所有现有用户，返回会变为无效的用户，
+// 不修改当前配置的校验函数。validate 为 nil 时与不校验相同，没有用户会变为无效。
+func (m *MinimalManager) SimulateValidator(validate func(name string) error) []PolicyViolation {
+	if validate == nil {
+		return nil
+	}
+	var violations []PolicyViolation
+	for _, user := range m.ListUsers(SortByID, false) {
+		if err := validate(user.Name); err != nil {
+			violations = append(violations, PolicyViolation{User: user, Error: err.Error()})
+		}
+	}
+	return violations
+}
+
+// idTaken 判断ID是否已被使用、预留或仍在回收站中
+func (m *MinimalManager) idTaken(id int) bool {
+	if _, exists := m.users[id]; exists {
+		return true
+	}
+	if _, trashed := m.trash[id]; trashed {
+		return true
+	}
+	return m.reserved[id]
+}
+
+// insert 写入用户，开启自动保存时同时写入存储
+func (m *MinimalManager) insert(user User) (User, error) {
+	m.users[user.ID] = user
+	if m.autoSave {
+		if err := m.storage.Put(user); err != nil {
+			return user, err
+		}
+	}
+	return user, nil
+}
+
+// errTxDone 事务已提交或回滚
+var errTxDone = errors.New("事务已结束")
+
+// Tx 事务，暂存多个添加和删除操作，提交时一次性生效。一个事务只能在一个 goroutine 中使用。
+type Tx struct {
+	m    *MinimalManager
+	ops  []txOp
+	done bool
+}
+
+// txOp 事务中的单个操作
+type txOp struct {
+	delete bool
+	id     int
+	name   string
+}
+
+// Begin 开始事务
+func (m *MinimalManager) Begin() *Tx {
+	return &Tx{m: m}
+}
+
+// AddUser 暂存添加用户，ID在提交时分配
+func (tx *Tx) AddUser(name string) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.ops = append(tx.ops, txOp{name: name})
+	return nil
+}
+
+// DeleteUser 暂存删除用户
+func (tx *Tx) DeleteUser(id int) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.ops = append(tx.ops, txOp{delete: true, id: id})
+	return nil
+}
+
+// Commit 提交事务，返回新建的用户。任一操作校验失败时所有操作都不生效，
+// 也不会消耗自增ID。
+func (tx *Tx) Commit() ([]User, error) {
+	if tx.done {
+		return nil, errTxDone
+	}
+	tx.done = true
+	tx.m.expireTrash()
+	added, deleted, applied, err := tx.m.commit(tx.ops)
+	if !applied {
+		return nil, err
+	}
+	for _, user := range added {
+		tx.m.userAdded(user)
+	}
+	for _, user := range deleted {
+		tx.m.userDeleted(user)
+	}
+	return added, err
+}
+
+// Rollback 放弃事务中暂存的操作
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	return nil
+}
+
+// commit 持锁校验并应用事务操作，applied 表示操作是否已写入内存
+func (m *MinimalManager) commit(ops []txOp) (added, deleted []User, applied bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// 先校验全部操作，再分配ID，出错时不修改任何数据，也不消耗ID
+	deleting := make(map[int]bool)
+	for _, op := range ops {
+		if !op.delete {
+			if err := m.validateName(op.name); err != nil {
+				return nil, nil, false, err
+			}
+			continue
+		}
+		if _, ok := m.users[op.id]; !ok || deleting[op.id] {
+			return nil, nil, false, fmt.Errorf("用户不存在: %d", op.id)
+		}
+		deleting[op.id] = true
+	}
+	nextID := m.nextID
+	newIDs := make(map[int]bool)
+	for _, op := range ops {
+		if op.delete {
+			continue
+		}
+		id := m.newID()
+		if m.idTaken(id) || newIDs[id] {
+			m.nextID = nextID
+			return nil, nil, false, fmt.Errorf("用户ID已存在: %d", id)
+		}
+		newIDs[id] = true
+		added = append(added, User{ID: id, Name: op.name, Version: 1})
+	}
+
+	now := time.Now()
+	for _, user := range added {
+		m.users[user.ID] = user
+		m.recordVersion(user)
+		m.publish(EventUserCreated, user)
+	}
+	for _, op := range ops {
+		if !op.delete {
+			continue
+		}
+		user := m.users[op.id]
+		delete(m.users, op.id)
+		m.trash[op.id] = TrashedUser{User: user, DeletedAt: now}
+		m.publish(EventUserDeleted, user)
+		deleted = append(deleted, user)
+	}
+	if m.autoSave {
+		err = m.saveAll()
+	}
+	return added, deleted, true, err
+}
+
+// OnUserAdded 注册用户添加后的回调，回调在锁外执行，可以调用管理器的方法
+func (m *MinimalManager) OnUserAdded(fn func(User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onAdded = append(m.onAdded, fn)
+}
+
+// userAdded 依次调用用户添加回调
+func (m *MinimalManager) userAdded(user User) {
+	m.mu.RLock()
+	hooks := m.onAdded
+	m.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(user)
+	}
+}
+
+// OnUserUpdated 注册用户修改后的回调，回调在锁外执行
+func (m *MinimalManager) OnUserUpdated(fn func(old, new User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onUpdated = append(m.onUpdated, fn)
+}
+
+// userUpdated 依次调用用户修改回调
+func (m *MinimalManager) userUpdated(old, new User) {
+	m.mu.RLock()
+	hooks := m.onUpdated
+	m.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(old, new)
+	}
+}
+
+// OnUserDeleted 注册用户删除后的回调，回调在锁外执行
+func (m *MinimalManager) OnUserDeleted(fn func(User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onDeleted = append(m.onDeleted, fn)
+}
+
+// userDeleted 依次调用用户删除回调
+func (m *MinimalManager) userDeleted(user User) {
+	m.mu.RLock()
+	hooks := m.onDeleted
+	m.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(user)
+	}
+}
+
+// OnUserRestored 注册用户从回收站恢复后的回调，回调在锁外执行
+func (m *MinimalManager) OnUserRestored(fn func(User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onRestored = append(m.onRestored, fn)
+}
+
+// userRestored 依次调用用户恢复回调
+func (m *MinimalManager) userRestored(user User) {
+	m.mu.RLock()
+	hooks := m.onRestored
+	m.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(user)
+	}
+}
+
+// OnUserPurged 注册用户从回收站彻底删除后的回调，包括超过保留时长被清理的用户，
+// 回调在锁外执行
+func (m *MinimalManager) OnUserPurged(fn func(User)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onPurged = append(m.onPurged, fn)
+}
+
+// userPurged 依次调用用户彻底删除回调
+func (m *MinimalManager) userPurged(user User) {
+	m.mu.RLock()
+	hooks := m.onPurged
+	m.mu.RUnlock()
+	for _, fn := range hooks {
+		fn(user)
+	}
+}
+
+// DeleteUser 删除用户，用户进入回收站，可以通过 RestoreUser 恢复
+func (m *MinimalManager) DeleteUser(id int) error {
+	m.expireTrash()
+	user, deleted, err := m.deleteUser(id)
+	if deleted {
+		m.userDeleted(user)
+	}
+	return err
+}
+
+// deleteUser 持锁将用户移入回收站
+func (m *MinimalManager) deleteUser(id int) (user User, deleted bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok {
+		return User{}, false, fmt.Errorf("用户不存在: %d", id)
+	}
+	delete(m.users, id)
+	m.trash[id] = TrashedUser{User: user, DeletedAt: time.Now()}
+	m.publish(EventUserDeleted, user)
+	// 先保存回收站再删除，中途失败时用户仍可从存储中找回
+	if m.autoSave {
+		err = m.storage.SaveMeta(m.meta())
+	}
+	if err == nil && m.autoSave {
+		err = m.storage.Delete(id)
+	}
+	return user, true, err
+}
+
+// userChange 一次用户修改的前后值
+type userChange struct {
+	old, new User
+}
+
+// ErrVersionConflict 用户已被其他调用修改，调用方应重新读取后再修改
+var ErrVersionConflict = errors.New("版本冲突")
+
+// UpdateUser 修改用户姓名，expectedVersion 为调用方读取到的版本号。
+// 用户已被修改过时返回包装了 ErrVersionConflict 的错误，可用 errors.Is 判断。
+func (m *MinimalManager) UpdateUser(id, expectedVersion int, name string) (User, error) {
+	c, changed, err := m.updateUser(id, expectedVersion, name)
+	if changed {
+		m.userUpdated(c.old, c.new)
+	}
+	return c.new, err
+}
+
+// updateUser 持锁检查版本并修改用户，changed 表示内存中的用户是否已修改
+func (m *MinimalManager) updateUser(id, expectedVersion int, name string) (c userChange, changed bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.users[id]
+	if !ok {
+		return userChange{}, false, fmt.Errorf("用户不存在: %d", id)
+	}
+	if old.Version != expectedVersion {
+		return userChange{}, false, fmt.Errorf("%w: 用户 %d 当前版本为 %d，期望 %d", ErrVersionConflict, id, old.Version, expectedVersion)
+	}
+	if old.Name == name {
+		return userChange{old: old, new: old}, false, nil
+	}
+	if err := m.validateName(name); err != nil {
+		return userChange{}, false, err
+	}
+	user := old
+	user.Name = name
+	user.Version++
+	m.users[id] = user
+	m.recordVersion(user)
+	m.publishUpdate(old, user)
+	if m.autoSave {
+		err = m.storage.Put(user)
+	}
+	return userChange{old: old, new: user}, true, err
+}
+
+// UpdateWhere 修改所有满足 filter 的用户，返回修改的用户数。
+// update 不能修改ID和版本号，修改的用户版本号加 1；任一用户修改后校验失败时所有修改都不生效。
+// filter 和 update 在锁外对快照求值，可以调用管理器的方法；
+// 求值期间被其他调用修改或删除的用户会被跳过。
+func (m *MinimalManager) UpdateWhere(filter func(User) bool, update func(*User)) (int, error) {
+	var changes []userChange
+	for _, old := range m.ListUsers(SortByID, false) {
+		if !filter(old) {
+			continue
+		}
+		user := old
+		update(&user)
+		user.ID, user.Version = old.ID, old.Version
+		if user != old {
+			user.Version++
+			changes = append(changes, userChange{old: old, new: user})
+		}
+	}
+	changes, err := m.updateWhere(changes)
+	for _, c := range changes {
+		m.userUpdated(c.old, c.new)
+	}
+	return len(changes), err
+}
+
+// updateWhere 持锁校验并应用修改，跳过快照之后已变化的用户
+func (m *MinimalManager) updateWhere(changes []userChange) ([]userChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var current []userChange
+	for _, c := range changes {
+		if m.users[c.old.ID] != c.old {
+			continue
+		}
+		if err := m.validateName(c.new.Name); err != nil {
+			return nil, fmt.Errorf("用户 %d 修改无效: %v", c.old.ID, err)
+		}
+		current = append(current, c)
+	}
+	var err error
+	for _, c := range current {
+		m.users[c.new.ID] = c.new
+		m.recordVersion(c.new)
+		m.publishUpdate(c.old, c.new)
+		if m.autoSave && err == nil {
+			err = m.storage.Put(c.new)
+		}
+	}
+	return current, err
+}
+
+// DeleteWhere 删除所有满足 filter 的用户，用户进入回收站，返回删除的用户数。
+// filter 在锁外对快照求值，可以调用管理器的方法；求值期间被其他调用修改或
+// 删除的用户会被跳过。
+func (m *MinimalManager) DeleteWhere(filter func(User) bool) (int, error) {
+	m.expireTrash()
+	var matched []User
+	for _, user := range m.ListUsers(SortByID, false) {
+		if filter(user) {
+			matched = append(matched, user)
+		}
+	}
+	deleted, err := m.deleteWhere(matched)
+	for _, user := range deleted {
+		m.userDeleted(user)
+	}
+	return len(deleted), err
+}
+
+// deleteWhere 持锁将匹配的用户移入回收站，跳过快照之后已变化的用户
+func (m *MinimalManager) deleteWhere(matched []User) ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted []User
+	now := time.Now()
+	for _, user := range matched {
+		if current, ok := m.users[user.ID]; !ok || current != user {
+			continue
+		}
+		delete(m.users, user.ID)
+		m.trash[user.ID] = TrashedUser{User: user, DeletedAt: now}
+		m.publish(EventUserDeleted, user)
+		deleted = append(deleted, user)
+	}
+	// 先保存回收站再删除，中途失败时用户仍可从存储中找回
+	if m.autoSave && len(deleted) > 0 {
+		if err := m.storage.SaveMeta(m.meta()); err != nil {
+			return deleted, err
+		}
+		for _, user := range deleted {
+			if err := m.storage.Delete(user.ID); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// maxUserVersions 每个用户保留的最近历史版本数
+const maxUserVersions = 100
+
+// UserVersion 用户的一个历史版本，Version 与该版本的 User.Version 相同
+type UserVersion struct {
+	Version int       `json:"version"`
+	User    User      `json:"user"`
+	At      time.Time `json:"at"`
+}
+
+// recordVersion 记录用户的新版本，调用方需持有写锁
+func (m *MinimalManager) recordVersion(user User) {
+	versions := append(m.history[user.ID], UserVersion{Version: user.Version, User: user, At: time.Now()})
+	if n := len(versions) - maxUserVersions; n > 0 {
+		versions = append(versions[:0], versions[n:]...)
+	}
+	m.history[user.ID] = versions
+}
+
+// History 返回用户的历史版本，按版本号升序。历史只保存在内存中，
+// 每个用户保留最近 maxUserVersions 个版本，彻底删除用户或 LoadFromFile 后清空。
+func (m *MinimalManager) History(id int) []UserVersion {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]UserVersion(nil), m.history[id]...)
+}
+
+// UserAt 返回用户在 t 时刻的版本，t 早于最早保留的版本时 ok 为 false
+func (m *MinimalManager) UserAt(id int, t time.Time) (user User, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, v := range m.history[id] {
+		if v.At.After(t) {
+			break
+		}
+		user, ok = v.User, true
+	}
+	return user, ok
+}
+
+// RevertUser 将用户恢复为指定历史版本，恢复本身记为一次修改并产生新版本
+func (m *MinimalManager) RevertUser(id, version int) (User, error) {
+	c, changed, err := m.revertUser(id, version)
+	if changed {
+		m.userUpdated(c.old, c.new)
+	}
+	return c.new, err
+}
+
+// revertUser 持锁校验并恢复历史版本，changed 表示内存中的用户是否已修改
+func (m *MinimalManager) revertUser(id, version int) (c userChange, changed bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.users[id]
+	if !ok {
+		return userChange{}, false, fmt.Errorf("用户不存在: %d", id)
+	}
+	var target *UserVersion
+	for i, v := range m.history[id] {
+		if v.Version == version {
+			target = &m.history[id][i]
+		}
+	}
+	if target == nil {
+		return userChange{}, false, fmt.Errorf("用户 %d 没有版本 %d", id, version)
+	}
+	user := target.User
+	user.Version = old.Version
+	if user == old {
+		return userChange{old: old, new: old}, false, nil
+	}
+	user.Version++
+	if err := m.validateName(user.Name); err != nil {
+		return userChange{}, false, fmt.Errorf("版本 %d 已不满足校验: %v", version, err)
+	}
+	m.users[id] = user
+	m.recordVersion(user)
+	m.publishUpdate(old, user)
+	if m.autoSave {
+		err = m.storage.Put(user)
+	}
+	return userChange{old: old, new: user}, true, err
+}
+
+// ListTrashed 返回回收站中的用户，按ID排序
+func (m *MinimalManager) ListTrashed() []TrashedUser {
+	m.expireTrash()
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.trashedUsers()
+}
+
+// trashedUsers 返回按ID排序的回收站用户，调用方需持有锁
+func (m *MinimalManager) trashedUsers() []TrashedUser {
+	trashed := make([]TrashedUser, 0, len(m.trash))
+	for _, t := range m.trash {
+		trashed = append(trashed, t)
+	}
+	sort.Slice(trashed, func(i, j int) bool {
+		return trashed[i].ID < trashed[j].ID
+	})
+	return trashed
+}
+
+// RestoreUser 从回收站恢复用户，之后调用 OnUserRestored 注册的回调，
+// 不会调用 OnUserAdded 的回调
+func (m *MinimalManager) RestoreUser(id int) (User, error) {
+	m.expireTrash()
+	user, restored, err := m.restoreUser(id)
+	if restored {
+		m.userRestored(user)
+	}
+	return user, err
+}
+
+// restoreUser 持锁将用户移出回收站，restored 表示用户是否已写入内存
+func (m *MinimalManager) restoreUser(id int) (user User, restored bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.trash[id]
+	if !ok {
+		return User{}, false, fmt.Errorf("回收站中没有该用户: %d", id)
+	}
+	if _, exists := m.users[id]; exists {
+		return User{}, false, fmt.Errorf("用户ID已存在: %d", id)
+	}
+	delete(m.trash, id)
+	user, err = m.insert(t.User)
+	m.publish(EventUserRestored, user)
+	if err == nil && m.autoSave {
+		err = m.storage.SaveMeta(m.meta())
+	}
+	return user, true, err
+}
+
+// PurgeUser 从回收站彻底删除用户，之后调用 OnUserPurged 注册的回调
+func (m *MinimalManager) PurgeUser(id int) error {
+	m.expireTrash()
+	user, purged, err := m.purgeUser(id)
+	if purged {
+		m.userPurged(user)
+	}
+	return err
+}
+
+// purgeUser 持锁彻底删除回收站中的用户
+func (m *MinimalManager) purgeUser(id int) (user User, purged bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.trash[id]; !ok {
+		return User{}, false, fmt.Errorf("回收站中没有该用户: %d", id)
+	}
+	user = m.purge(id)
+	if m.autoSave {
+		err = m.storage.SaveMeta(m.meta())
+	}
+	return user, true, err
+}
+
+// EmptyTrash 清空回收站，返回删除的用户数，每个用户都会调用 OnUserPurged 注册的回调
+func (m *MinimalManager) EmptyTrash() (int, error) {
+	m.expireTrash()
+	purged, err := m.emptyTrash()
+	for _, user := range purged {
+		m.userPurged(user)
+	}
+	return len(purged), err
+}
+
+// emptyTrash 持锁按ID顺序彻底删除回收站中的全部用户
+func (m *MinimalManager) emptyTrash() ([]User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var purged []User
+	for _, t := range m.trashedUsers() {
+		purged = append(purged, m.purge(t.ID))
+	}
+	if m.autoSave && len(purged) > 0 {
+		return purged, m.storage.SaveMeta(m.meta())
+	}
+	return purged, nil
+}
+
+// expireTrash 彻底删除超过保留时长的回收站用户并调用 OnUserPurged 注册的回调。
+// 过期的用户不单独持久化，LoadFromFile 时会再次按保留时长过滤。
+func (m *MinimalManager) expireTrash() {
+	if m.trashRetention <= 0 {
+		return
+	}
+	m.mu.Lock()
+	var purged []User
+	for _, t := range m.trashedUsers() {
+		if m.expired(t) {
+			purged = append(purged, m.purge(t.ID))
+		}
+	}
+	m.mu.Unlock()
+	for _, user := range purged {
+		m.userPurged(user)
+	}
+}
+
+// expired 判断回收站用户是否超过保留时长
+func (m *MinimalManager) expired(t TrashedUser) bool {
+	return m.trashRetention > 0 && t.DeletedAt.Before(time.Now().Add(-m.trashRetention))
+}
+
+// purge 从回收站彻底删除用户并发布事件，调用方需持有写锁且用户在回收站中
+func (m *MinimalManager) purge(id int) User {
+	user := m.trash[id].User
+	delete(m.trash, id)
+	delete(m.history, id)
+	m.publish(EventUserPurged, user)
+	return user
+}
+
+// Subscribe 订阅用户变更事件，buffer 为通道缓冲大小，返回事件通道和退订函数。
+// 事件按修改生效的顺序投递。每个订阅者有独立的无界队列，读取慢的订阅者
+// 不会阻塞修改操作或其他订阅者。退订后队列中未读的事件被丢弃，通道随之关闭。
+func (m *MinimalManager) Subscribe(buffer int) (<-chan Event, func()) {
+	sub := &subscriber{
+		ch:   make(chan Event, buffer),
+		done: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+	}
+	m.subMu.Lock()
+	m.subs[sub] = struct{}{}
+	m.subMu.Unlock()
+	go sub.run()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			m.subMu.Lock()
+			delete(m.subs, sub)
+			m.subMu.Unlock()
+			close(sub.done)
+		})
+	}
+	return sub.ch, unsubscribe
+}
+
+// publish 发布用户事件，调用方需持有写锁
+func (m *MinimalManager) publish(eventType EventType, user User) {
+	m.dispatch(Event{Type: eventType, User: user})
+}
+
+// publishUpdate 发布带有修改前用户的修改事件，调用方需持有写锁
+func (m *MinimalManager) publishUpdate(old, user User) {
+	m.dispatch(Event{Type: EventUserUpdated, User: user, Old: &old})
+}
+
+// dispatch 为事件分配序号并放入所有订阅者的队列，调用方需持有写锁，
+// 从而保证序号与修改生效的顺序一致
+func (m *MinimalManager) dispatch(event Event) {
+	m.eventSeq++
+	event.Seq = m.eventSeq
+	event.At = time.Now()
+	m.subMu.RLock()
+	defer m.subMu.RUnlock()
+	for sub := range m.subs {
+		sub.enqueue(event)
+	}
+}
+
+// GetUser 根据ID获取用户
+func (m *MinimalManager) GetUser(id int) (User, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[id]
+	return user, ok
+}
+
+// GetUsers 批量获取用户，按传入顺序返回，不存在的ID被跳过
+func (m *MinimalManager) GetUsers(ids []int) []User {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := make([]User, 0, len(ids))
+	for _, id := range ids {
+		if user, ok := m.users[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// Match 单个字段的匹配信息，Offsets 为匹配起始的字节偏移
+type Match struct {
+	Field   string `json:"field"`
+	Offsets []int  `json:"offsets"`
+}
+
+// SearchResult 搜索结果
+type SearchResult struct {
+	User    User    `json:"user"`
+	Matches []Match `json:"matches"`
+}
+
+// SearchUsers 按关键字搜索用户，结果按ID排序
+func (m *MinimalManager) SearchUsers(keyword string) []SearchResult {
+	var results []SearchResult
+	if keyword == "" {
+		return results
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, user := range m.users {
+		offsets := matchOffsets(user.Name, keyword)
+		if len(offsets) == 0 {
+			continue
+		}
+		results = append(results, SearchResult{
+			User:    user,
+			Matches: []Match{{Field: "name", Offsets: offsets}},
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].User.ID < results[j].User.ID
+	})
+	return results
+}
+
+// matchOffsets 返回 keyword 在 s 中所有不重叠出现的字节偏移
+func matchOffsets(s, keyword string) []int {
+	var offsets []int
+	for start := 0; ; {
+		i := strings.Index(s[start:], keyword)
+		if i < 0 {
+			return offsets
+		}
+		offsets = append(offsets, start+i)
+		start += i + len(keyword)
+	}
+}
+
+// SortField 排序字段
+type SortField string
+
+const (
+	// SortByID 按ID排序
+	SortByID SortField = "id"
+	// SortByName 按姓名排序，姓名相同时按ID升序排序
+	SortByName SortField = "name"
+)
+
+// ListUsers 返回排序后的用户列表，未知的排序字段按ID排序
+func (m *MinimalManager) ListUsers(sortBy SortField, desc bool) []User {
+	m.mu.RLock()
+	users := m.sortedUsers()
+	m.mu.RUnlock()
+	if sortBy == SortByName {
+		// 只对姓名应用 desc，姓名相同时保持ID升序
+		sort.SliceStable(users, func(i, j int) bool {
+			if desc {
+				return users[i].Name > users[j].Name
+			}
+			return users[i].Name < users[j].Name
+		})
+	} else if desc {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+	return users
+}
+
+// Query 组合查询，条件之间为“与”关系
+type Query struct {
+	m       *MinimalManager
+	filters []func(User) bool
+	sortBy  SortField
+	desc    bool
+	limit   int
+}
+
+// Query 创建查询，默认按ID升序、不限数量
+func (m *MinimalManager) Query() *Query {
+	return &Query{m: m, sortBy: SortByID}
+}
+
+// NameContains 姓名包含 keyword
+func (q *Query) NameContains(keyword string) *Query {
+	return q.Where(func(u User) bool {
+		return strings.Contains(u.Name, keyword)
+	})
+}
+
+// IDBetween ID在 [from, to] 范围内
+func (q *Query) IDBetween(from, to int) *Query {
+	return q.Where(func(u User) bool {
+		return u.ID >= from && u.ID <= to
+	})
+}
+
+// Where 自定义条件
+func (q *Query) Where(filter func(User) bool) *Query {
+	q.filters = append(q.filters, filter)
+	return q
+}
+
+// SortBy 设置排序
+func (q *Query) SortBy(field SortField, desc bool) *Query {
+	q.sortBy, q.desc = field, desc
+	return q
+}
+
+// Limit 限制返回数量，0 表示不限
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Run 执行查询，条件在锁外求值
+func (q *Query) Run() []User {
+	var result []User
+	for _, user := range q.m.ListUsers(q.sortBy, q.desc) {
+		if q.limit > 0 && len(result) == q.limit {
+			break
+		}
+		if q.match(user) {
+			result = append(result, user)
+		}
+	}
+	return result
+}
+
+// match 判断用户是否满足全部条件
+func (q *Query) match(user User) bool {
+	for _, filter := range q.filters {
+		if !filter(user) {
+			return false
+		}
+	}
+	return true
+}
+
+// FindUsers 返回满足 predicate 的用户，按ID排序。predicate 在锁外调用。
+func (m *MinimalManager) FindUsers(predicate func(User) bool) []User {
+	return m.Query().Where(predicate).Run()
+}
+
+// CountUsers 返回满足 predicate 的用户数，predicate 在锁外对未排序的快照调用
+func (m *MinimalManager) CountUsers(predicate func(User) bool) int {
+	m.mu.RLock()
+	users := make([]User, 0, len(m.users))
 	for _, user := range m.users {
-		fmt.Printf("ID: %d, 姓名: %s\n", user.ID, user.Name)
+		users = append(users, user)
+	}
+	m.mu.RUnlock()
+	n := 0
+	for _, user := range users {
+		if predicate(user) {
+			n++
+		}
+	}
+	return n
+}
+
+// ShowUsers 按ID顺序显示所有用户
+func (m *MinimalManager) ShowUsers() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	fmt.Fprintln(m.out, "用户列表:")
+	for _, user := range m.sortedUsers() {
+		fmt.Fprintf(m.out, "ID: %s, 姓名: %s\n", m.FormatID(user.ID), user.Name)
 	}
 }
 
-// SaveToFile 保存到文件
-func (m *MinimalManager) SaveToFile() {
-	data := ""
+// FormatID 按配置的显示格式格式化ID
+func (m *MinimalManager) FormatID(id int) string {
+	return m.idPrefix + fmt.Sprintf("%0*d", m.idWidth, id)
+}
+
+// sortedUsers 返回按ID升序排列的用户
+func (m *MinimalManager) sortedUsers() []User {
+	users := make([]User, 0, len(m.users))
 	for _, user := range m.users {
-		data += fmt.Sprintf("%d,%s\n", user.ID, user.Name)
+		users = append(users, user)
+	}
+	sortUsersByID(users)
+	return users
+}
+
+// SaveToFile 将全部用户和元数据写入存储，文件存储按ID顺序写入，数据不变时文件内容也不变
+func (m *MinimalManager) SaveToFile() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveAll()
+}
+
+// saveAll 写入全部用户和元数据，调用方需持有锁。
+// 用户和回收站分两次写入，写入顺序保证中途失败时每个用户仍在其中之一：
+// 先保存包含新删除用户的回收站（存储中已有的回收站用户暂时保留），
+// 再保存用户，最后保存最终的回收站。
+func (m *MinimalManager) saveAll() error {
+	stored, err := m.storage.LoadMeta()
+	if err != nil {
+		return err
+	}
+	meta := m.meta()
+	merged := copyMeta(meta)
+	inTrash := make(map[int]bool, len(meta.Trash))
+	for _, t := range meta.Trash {
+		inTrash[t.ID] = true
+	}
+	for _, t := range stored.Trash {
+		if !inTrash[t.ID] {
+			merged.Trash = append(merged.Trash, t)
+		}
+	}
+	if err := m.storage.SaveMeta(merged); err != nil {
+		return err
+	}
+	if err := m.storage.Save(m.sortedUsers()); err != nil {
+		return err
+	}
+	if len(merged.Trash) == len(meta.Trash) {
+		return nil
+	}
+	return m.storage.SaveMeta(meta)
+}
+
+// LoadFromFile 从存储读取用户和元数据，替换内存中的用户、预留和回收站
+func (m *MinimalManager) LoadFromFile() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users, err := m.storage.Load()
+	if err != nil {
+		return err
+	}
+	meta, err := m.storage.LoadMeta()
+	if err != nil {
+		return err
+	}
+	m.users = make(map[int]User, len(users))
+	for _, user := range users {
+		if user.Version == 0 {
+			// 加入版本号之前保存的用户
+			user.Version = 1
+		}
+		m.users[user.ID] = user
+		m.advanceNextID(user.ID)
+	}
+	m.history = make(map[int][]UserVersion)
+	m.trash = make(map[int]TrashedUser, len(meta.Trash))
+	for _, t := range meta.Trash {
+		if t.Version == 0 {
+			t.Version = 1
+		}
+		if _, exists := m.users[t.ID]; !exists && !m.expired(t) {
+			m.trash[t.ID] = t
+		}
+		m.advanceNextID(t.ID)
+	}
+	m.reserved = make(map[int]bool, len(meta.Reserved))
+	for _, id := range meta.Reserved {
+		if _, exists := m.users[id]; exists {
+			continue
+		}
+		m.reserved[id] = true
+		m.advanceNextID(id)
+	}
+	if meta.NextID > m.nextID {
+		m.nextID = meta.NextID
+	}
+	return nil
+}
+
+// advanceNextID 保证自增ID不会再分配 id，调用方需持有锁
+func (m *MinimalManager) advanceNextID(id int) {
+	if id >= m.nextID {
+		m.nextID = id + 1
+	}
+}
+
+// meta 返回当前需要持久化的元数据，调用方需持有锁
+func (m *MinimalManager) meta() Meta {
+	meta := Meta{NextID: m.nextID}
+	for id := range m.reserved {
+		meta.Reserved = append(meta.Reserved, id)
+	}
+	sort.Ints(meta.Reserved)
+	for _, t := range m.trash {
+		t.DeletedAt = t.DeletedAt.Round(0)
+		meta.Trash = append(meta.Trash, t)
 	}
-	ioutil.WriteFile("users.txt", []byte(data), 0644)
+	sort.Slice(meta.Trash, func(i, j int) bool {
+		return meta.Trash[i].ID < meta.Trash[j].ID
+	})
+	return meta
 }
 
 func main() {
 	manager := NewMinimalManager()
 
 	// 添加用户
-	manager.AddUser("张三")
-	manager.AddUser("李四")
-	manager.AddUser("王五")
+	result, err := manager.AddUsers([]string{"张三", "李四", "王五"})
+	if err != nil {
+		for _, failure := range result.Failed {
+			fmt.Printf("添加用户 %s 失败: %s\n", failure.Name, failure.Error)
+		}
+	}
 
 	// 显示用户
 	manager.ShowUsers()
 
 	// 保存文件
-	manager.SaveToFile()
+	if err := manager.SaveToFile(); err != nil {
+		fmt.Println("保存失败:", err)
+		return
+	}
 	fmt.Println("数据已保存到 users.txt")
 }
@@ -0,0 +1,998 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrentUse 在多个 goroutine 中同时调用管理器的方法，需配合 -race 运行
+func TestConcurrentUse(t *testing.T) {
+	m := NewMinimalManager(
+		WithStorage(NewMemoryStorage()),
+		WithOutput(ioutil.Discard),
+		WithAutoSave(true),
+	)
+	m.OnUserAdded(func(u User) { m.GetUser(u.ID) })
+	events, unsubscribe := m.Subscribe(16)
+	drained := make(chan struct{})
+	go func() {
+		for range events {
+		}
+		close(drained)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := m.AddUser(fmt.Sprintf("用户%d", i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			m.GetUsers([]int{user.ID, user.ID + 1})
+			m.SearchUsers("用户")
+			m.ListUsers(SortByName, true)
+			m.FindUsers(func(u User) bool { return strings.HasSuffix(u.Name, "!") })
+			m.ShowUsers()
+			m.UpdateWhere(func(u User) bool { return u.ID == user.ID }, func(u *User) { u.Name += "!" })
+			if err := m.DeleteUser(user.ID); err != nil {
+				t.Error(err)
+			}
+			m.ListTrashed()
+			if _, err := m.RestoreUser(user.ID); err != nil {
+				t.Error(err)
+			}
+			tx := m.Begin()
+			tx.AddUser(fmt.Sprintf("事务%d", i))
+			if _, err := tx.Commit(); err != nil {
+				t.Error(err)
+			}
+			if id, err := m.ReserveID(); err == nil {
+				m.AddUserWithID(id, "预留")
+			}
+			m.DeleteWhere(func(u User) bool { return u.Name == "预留" })
+			m.SaveToFile()
+		}(i)
+	}
+	wg.Wait()
+	unsubscribe()
+	<-drained
+
+	if n := m.CountUsers(func(User) bool { return true }); n != 32 {
+		t.Fatalf("用户数为 %d，期望 32", n)
+	}
+}
+
+func TestEventsDeliveredInOrder(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	events, unsubscribe := m.Subscribe(0)
+	defer unsubscribe()
+	_, unsubscribeIdle := m.Subscribe(0) // 从不读取，不能阻塞其他人
+	defer unsubscribeIdle()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := m.AddUser("用户")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := m.DeleteUser(user.ID); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	created := make(map[int]bool)
+	for seq := uint64(1); seq <= 100; seq++ {
+		event := <-events
+		if event.Seq != seq {
+			t.Fatalf("事件序号为 %d，期望 %d", event.Seq, seq)
+		}
+		switch event.Type {
+		case EventUserCreated:
+			created[event.User.ID] = true
+		case EventUserDeleted:
+			if !created[event.User.ID] {
+				t.Fatalf("用户 %d 的删除事件早于创建事件", event.User.ID)
+			}
+		}
+	}
+}
+
+func TestStalledWebhookDoesNotBlockMutations(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	hook, err := m.AddWebhook(srv.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := make(chan struct{})
+	go func() {
+		for i := 0; i < maxWebhookQueue+200; i++ {
+			m.AddUser("用户")
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(10 * time.Second):
+		t.Fatal("接收方无响应时 AddUser 被阻塞")
+	}
+
+	waitFor(t, func() bool {
+		for _, d := range hook.Deliveries() {
+			if d.Attempts == 0 && !d.Delivered {
+				return true
+			}
+		}
+		return false
+	}, "队列满时丢弃的事件没有被记录")
+
+	hook.Close()
+	waitFor(t, func() bool {
+		for _, d := range hook.Deliveries() {
+			if d.Attempts > 0 && strings.Contains(d.LastError, "canceled") {
+				return true
+			}
+		}
+		return false
+	}, "Close 没有取消正在进行的推送")
+}
+
+// newTestWebhook 注册重试间隔很短的 Webhook
+func newTestWebhook(t *testing.T, m *MinimalManager, url string, maxAttempts int) *Webhook {
+	t.Helper()
+	hook, err := m.AddWebhook(url, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook.maxAttempts = maxAttempts
+	hook.baseDelay = 20 * time.Millisecond
+	t.Cleanup(hook.Close)
+	return hook
+}
+
+// lastDelivery 等待出现推送记录并返回最后一条
+func lastDelivery(t *testing.T, hook *Webhook) WebhookDelivery {
+	t.Helper()
+	waitFor(t, func() bool { return len(hook.Deliveries()) > 0 }, "没有推送记录")
+	deliveries := hook.Deliveries()
+	return deliveries[len(deliveries)-1]
+}
+
+func TestWebhookSignsBody(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Signature-256") != want {
+			http.Error(w, "签名错误", http.StatusUnauthorized)
+			return
+		}
+		bodies <- body
+	}))
+	defer srv.Close()
+
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	hook := newTestWebhook(t, m, srv.URL, 1)
+	m.AddUser("张三")
+
+	d := lastDelivery(t, hook)
+	if !d.Delivered || d.Attempts != 1 {
+		t.Fatalf("推送记录为 %+v", d)
+	}
+	var event Event
+	if err := json.Unmarshal(<-bodies, &event); err != nil || event.Type != EventUserCreated || event.User.Name != "张三" {
+		t.Fatalf("请求体为 %+v, %v", event, err)
+	}
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if len(times) <= 2 {
+			http.Error(w, "暂时不可用", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	hook := newTestWebhook(t, m, srv.URL, 5)
+	m.AddUser("张三")
+
+	d := lastDelivery(t, hook)
+	if !d.Delivered || d.Attempts != 3 || d.LastError != "" {
+		t.Fatalf("推送记录为 %+v，期望第 3 次成功", d)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if first, second := times[1].Sub(times[0]), times[2].Sub(times[1]); first < 20*time.Millisecond || second < 40*time.Millisecond {
+		t.Fatalf("重试间隔为 %v, %v，期望指数退避", first, second)
+	}
+}
+
+func TestWebhookRetryPolicy(t *testing.T) {
+	tests := []struct {
+		status   int
+		attempts int
+	}{
+		{http.StatusBadRequest, 1},
+		{http.StatusNotFound, 1},
+		{http.StatusRequestTimeout, 3},
+		{http.StatusTooManyRequests, 3},
+		{http.StatusInternalServerError, 3},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+		hook := newTestWebhook(t, m, srv.URL, 3)
+		m.AddUser("张三")
+		d := lastDelivery(t, hook)
+		if d.Delivered || d.Attempts != tt.attempts {
+			t.Errorf("状态 %d: 推送记录为 %+v，期望尝试 %d 次", tt.status, d, tt.attempts)
+		}
+		srv.Close()
+	}
+}
+
+func TestAddWebhookRejectsInvalidURL(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	for _, u := range []string{"::bad", "example.com/hook", "ftp://example.com", "http://"} {
+		if hook, err := m.AddWebhook(u, "secret"); err == nil {
+			hook.Close()
+			t.Errorf("AddWebhook(%q) 应返回错误", u)
+		}
+	}
+}
+
+// waitFor 等待 cond 成立，超时则失败
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileStorageRoundTripsAnyName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	names := []string{"张三", "a\nb", "c\r\nd", `"引号"`, "逗号,姓名", ""}
+	m := NewMinimalManager(WithFilename(path))
+	for _, name := range names {
+		if _, err := m.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SaveToFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewMinimalManager(WithFilename(path))
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		user, ok := reloaded.GetUser(i + 1)
+		if !ok || user.Name != name {
+			t.Errorf("ID %d: 得到 %q，期望 %q", i+1, user.Name, name)
+		}
+	}
+}
+
+func TestReservedIDSurvivesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	m := NewMinimalManager(WithFilename(path), WithAutoSave(true))
+	id, err := m.ReserveID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewMinimalManager(WithFilename(path))
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	user, err := reloaded.AddUser("张三")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == id {
+		t.Fatalf("预留的ID %d 在重启后被重新分配", id)
+	}
+	if _, err := reloaded.AddUserWithID(id, "李四"); err != nil {
+		t.Fatalf("重启后预留失效: %v", err)
+	}
+}
+
+func TestReserveIDRollsBackOnSaveFailure(t *testing.T) {
+	storage := &faultyStorage{MemoryStorage: NewMemoryStorage(), metaErr: fmt.Errorf("磁盘已满")}
+	m := NewMinimalManager(WithStorage(storage), WithAutoSave(true))
+	if id, err := m.ReserveID(); err == nil {
+		t.Fatalf("期望保存失败，得到ID %d", id)
+	}
+	storage.metaErr = nil
+	if _, err := m.AddUserWithID(1, "张三"); err == nil {
+		t.Fatal("保存失败的预留不应保留")
+	}
+}
+
+func TestEventLogLongNameAndTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	long := strings.Repeat("长", 70*1024/3)
+	m := NewMinimalManager(WithStorage(NewEventLogStorage(path)), WithAutoSave(true))
+	if _, err := m.AddUser(long); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddUser("张三"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"type":"Created","user":{"id":3,`)
+	f.Close()
+
+	before, _ := ioutil.ReadFile(path)
+	reloaded := NewMinimalManager(WithStorage(NewEventLogStorage(path)), WithAutoSave(true))
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(path); string(after) != string(before) {
+		t.Fatal("读取不应修改日志文件")
+	}
+	if user, ok := reloaded.GetUser(1); !ok || user.Name != long {
+		t.Fatal("长用户名没有被正确重放")
+	}
+	if _, ok := reloaded.GetUser(3); ok {
+		t.Fatal("不完整的末行不应被应用")
+	}
+	if _, err := reloaded.AddUser("李四"); err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewEventLogStorage(path).Load()
+	if err != nil {
+		t.Fatalf("截断后继续追加的日志无法重放: %v", err)
+	}
+	if len(users) != 3 || users[2].Name != "李四" {
+		t.Fatalf("重放得到 %v", users)
+	}
+}
+
+func TestTrashSurvivesReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	m := NewMinimalManager(WithFilename(path), WithAutoSave(true))
+	for _, name := range []string{"张三", "李四"} {
+		if _, err := m.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.DeleteUser(2); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewMinimalManager(WithFilename(path), WithAutoSave(true))
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	user, err := reloaded.AddUser("王五")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID == 2 {
+		t.Fatal("回收站中的ID在重启后被重新分配")
+	}
+	restored, err := reloaded.RestoreUser(2)
+	if err != nil {
+		t.Fatalf("重启后无法恢复已删除的用户: %v", err)
+	}
+	if restored.Name != "李四" {
+		t.Fatalf("恢复的用户为 %q，期望 李四", restored.Name)
+	}
+}
+
+// faultyStorage 可以让指定操作失败的内存存储
+type faultyStorage struct {
+	*MemoryStorage
+	putErr  error
+	metaErr error
+}
+
+func (s *faultyStorage) Put(user User) error {
+	if s.putErr != nil {
+		return s.putErr
+	}
+	return s.MemoryStorage.Put(user)
+}
+
+func (s *faultyStorage) SaveMeta(meta Meta) error {
+	if s.metaErr != nil {
+		return s.metaErr
+	}
+	return s.MemoryStorage.SaveMeta(meta)
+}
+
+func TestAddUsersReportsSaveFailures(t *testing.T) {
+	m := NewMinimalManager(
+		WithStorage(&faultyStorage{MemoryStorage: NewMemoryStorage(), putErr: fmt.Errorf("磁盘已满")}),
+		WithAutoSave(true),
+		WithValidator(func(name string) error {
+			if name == "" {
+				return fmt.Errorf("姓名不能为空")
+			}
+			return nil
+		}),
+	)
+	result, err := m.AddUsers([]string{"张三", ""})
+	if err == nil {
+		t.Fatal("期望返回汇总错误")
+	}
+	if len(result.Created) != 1 || result.Created[0].Name != "张三" {
+		t.Fatalf("Created 为 %v，期望包含已添加的张三", result.Created)
+	}
+	if len(result.SaveFailed) != 1 || result.SaveFailed[0].Index != 0 {
+		t.Fatalf("SaveFailed 为 %v", result.SaveFailed)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Index != 1 {
+		t.Fatalf("Failed 为 %v", result.Failed)
+	}
+	if _, ok := m.GetUser(result.Created[0].ID); !ok {
+		t.Fatal("保存失败的用户应已在内存中")
+	}
+}
+
+func TestBulkPredicatesMayCallManager(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	for _, name := range []string{"张三", "李四", "王五"} {
+		if _, err := m.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := m.UpdateWhere(func(u User) bool {
+		_, ok := m.GetUser(u.ID)
+		return ok && u.ID != 2
+	}, func(u *User) { u.Name += "!" })
+	if err != nil || n != 2 {
+		t.Fatalf("UpdateWhere 返回 %d, %v，期望 2", n, err)
+	}
+	n, err = m.DeleteWhere(func(u User) bool {
+		if u.ID == 1 {
+			// 快照之后被修改，应跳过
+			m.UpdateWhere(func(u User) bool { return u.ID == 3 }, func(u *User) { u.Name = "赵六" })
+		}
+		return u.ID != 2
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("DeleteWhere 返回 %d, %v，期望 1", n, err)
+	}
+	if user, ok := m.GetUser(3); !ok || user.Name != "赵六" {
+		t.Fatalf("快照之后修改的用户不应被删除: %v", user)
+	}
+}
+
+func TestListUsersByNameDescKeepsIDOrderForTies(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	for _, name := range []string{"b", "a", "b", "a"} {
+		if _, err := m.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ids []int
+	for _, user := range m.ListUsers(SortByName, true) {
+		ids = append(ids, user.ID)
+	}
+	if fmt.Sprint(ids) != "[1 3 2 4]" {
+		t.Fatalf("降序结果为 %v，期望 [1 3 2 4]", ids)
+	}
+}
+
+func TestSimulateNilValidator(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	if _, err := m.AddUser("张三"); err != nil {
+		t.Fatal(err)
+	}
+	if violations := m.SimulateValidator(nil); len(violations) != 0 {
+		t.Fatalf("nil 校验函数不应产生违规: %v", violations)
+	}
+}
+
+func TestMatchOffsets(t *testing.T) {
+	tests := []struct {
+		s, keyword string
+		want       []int
+	}{
+		{"张三张三", "张三", []int{0, 6}},
+		{"张三张三", "三", []int{3, 9}},
+		{"张三张三", "三张", []int{3}},
+		{"aaaa", "aa", []int{0, 2}},
+		{"aaa", "aa", []int{0}},
+		{"张三", "李四", nil},
+	}
+	for _, tt := range tests {
+		got := matchOffsets(tt.s, tt.keyword)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("matchOffsets(%q, %q) = %v，期望 %v", tt.s, tt.keyword, got, tt.want)
+		}
+	}
+
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	m.AddUser("张三张三")
+	m.AddUser("李四")
+	results := m.SearchUsers("张三")
+	if len(results) != 1 || fmt.Sprint(results[0].Matches) != "[{name [0 6]}]" {
+		t.Fatalf("搜索结果为 %v", results)
+	}
+}
+
+func TestFileStorageLoadsLegacyNamesVerbatim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	if err := ioutil.WriteFile(path, []byte("1,\"hi\"\n2,张三\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage := NewFileStorage(path)
+	for round := 0; round < 2; round++ {
+		users, err := storage.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 2 || users[0].Name != `"hi"` || users[1].Name != "张三" {
+			t.Fatalf("第%d次读取得到 %v", round+1, users)
+		}
+		if err := storage.Save(users); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFormatID(t *testing.T) {
+	tests := []struct {
+		prefix string
+		width  int
+		id     int
+		want   string
+	}{
+		{"", 0, 5, "5"},
+		{"USR-", 6, 123, "USR-000123"},
+		{"USR", 0, 5, "USR5"},
+		{"%d-", 2, 5, "%d-05"},
+		{"U", 2, 12345, "U12345"},
+		{"U", -3, 5, "U5"},
+	}
+	for _, tt := range tests {
+		m := NewMinimalManager(WithIDFormat(tt.prefix, tt.width))
+		if got := m.FormatID(tt.id); got != tt.want {
+			t.Errorf("FormatID(%d) 使用 (%q, %d) 得到 %q，期望 %q", tt.id, tt.prefix, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestShowUsersUsesIDFormat(t *testing.T) {
+	var out strings.Builder
+	m := NewMinimalManager(
+		WithStorage(NewMemoryStorage()),
+		WithOutput(&out),
+		WithIDFormat("USR-", 4),
+	)
+	m.AddUser("张三")
+	m.ShowUsers()
+	if want := "用户列表:\nID: USR-0001, 姓名: 张三\n"; out.String() != want {
+		t.Fatalf("输出为 %q，期望 %q", out.String(), want)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	m.AddUser("不记录")
+	audit, err := m.AddAuditLog(path, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := m.AddUser("张三")
+	m.UpdateWhere(func(u User) bool { return u.ID == user.ID }, func(u *User) { u.Name = "李四" })
+	m.DeleteUser(user.ID)
+
+	records, err := audit.ListAuditEvents(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []EventType
+	for _, r := range records {
+		types = append(types, r.Type)
+		if r.Actor != "admin" || r.User.ID != user.ID || r.At.IsZero() {
+			t.Errorf("记录不完整: %+v", r)
+		}
+	}
+	if fmt.Sprint(types) != "[UserCreated UserUpdated UserDeleted]" {
+		t.Fatalf("记录类型为 %v", types)
+	}
+	if old := records[1].Old; old == nil || old.Name != "张三" || records[1].User.Name != "李四" {
+		t.Fatalf("修改记录缺少新旧值: %+v", records[1])
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m2 := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	audit2, err := m2.AddAuditLog(path, "ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit2.Close()
+	m2.AddUser("王五")
+	updated, err := audit2.ListAuditEvents(AuditFilter{Type: EventUserUpdated})
+	if err != nil || len(updated) != 1 {
+		t.Fatalf("按类型筛选得到 %v, %v", updated, err)
+	}
+	all, err := audit2.ListAuditEvents(AuditFilter{Since: records[2].At})
+	if err != nil || len(all) != 2 || all[1].Actor != "ops" {
+		t.Fatalf("重启后的记录为 %+v, %v", all, err)
+	}
+}
+
+func TestHistoryAndRevert(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	user, _ := m.AddUser("张三")
+	rename := func(name string) {
+		m.UpdateWhere(func(u User) bool { return u.ID == user.ID }, func(u *User) { u.Name = name })
+	}
+	rename("李四")
+	between := time.Now()
+	time.Sleep(time.Millisecond)
+	rename("王五")
+
+	var names []string
+	for _, v := range m.History(user.ID) {
+		names = append(names, fmt.Sprintf("%d:%s", v.Version, v.User.Name))
+	}
+	if fmt.Sprint(names) != "[1:张三 2:李四 3:王五]" {
+		t.Fatalf("历史为 %v", names)
+	}
+	if old, ok := m.UserAt(user.ID, between); !ok || old.Name != "李四" {
+		t.Fatalf("UserAt 得到 %v, %v，期望 李四", old, ok)
+	}
+
+	var updated []string
+	m.OnUserUpdated(func(old, new User) { updated = append(updated, old.Name+"->"+new.Name) })
+	reverted, err := m.RevertUser(user.ID, 1)
+	if err != nil || reverted.Name != "张三" {
+		t.Fatalf("RevertUser 得到 %v, %v", reverted, err)
+	}
+	if fmt.Sprint(updated) != "[王五->张三]" {
+		t.Fatalf("修改回调为 %v", updated)
+	}
+	if h := m.History(user.ID); len(h) != 4 || h[3].User.Name != "张三" {
+		t.Fatalf("恢复应产生新版本: %v", h)
+	}
+	if _, err := m.RevertUser(user.ID, 9); err == nil {
+		t.Fatal("不存在的版本应返回错误")
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()), WithTrashRetention(time.Hour))
+	var calls []string
+	m.OnUserAdded(func(u User) { calls = append(calls, "added:"+u.Name) })
+	m.OnUserUpdated(func(old, new User) { calls = append(calls, "updated:"+old.Name+"->"+new.Name) })
+	m.OnUserDeleted(func(u User) { calls = append(calls, "deleted:"+u.Name) })
+	m.OnUserRestored(func(u User) { calls = append(calls, "restored:"+u.Name) })
+	m.OnUserPurged(func(u User) { calls = append(calls, "purged:"+u.Name) })
+
+	user, _ := m.AddUser("张三")
+	m.UpdateWhere(func(u User) bool { return u.ID == user.ID }, func(u *User) { u.Name = "李四" })
+	m.DeleteUser(user.ID)
+	m.RestoreUser(user.ID)
+	m.DeleteWhere(func(User) bool { return true })
+	m.PurgeUser(user.ID)
+	other, _ := m.AddUser("王五")
+	m.DeleteUser(other.ID)
+	m.EmptyTrash()
+
+	want := "[added:张三 updated:张三->李四 deleted:李四 restored:李四 deleted:李四 purged:李四 " +
+		"added:王五 deleted:王五 purged:王五]"
+	if fmt.Sprint(calls) != want {
+		t.Fatalf("回调顺序为 %v\n期望 %v", calls, want)
+	}
+}
+
+func TestExpiredTrashFiresPurgeHook(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()), WithTrashRetention(time.Millisecond))
+	var purged []int
+	m.OnUserPurged(func(u User) { purged = append(purged, u.ID) })
+	user, _ := m.AddUser("张三")
+	m.DeleteUser(user.ID)
+	time.Sleep(5 * time.Millisecond)
+	if trashed := m.ListTrashed(); len(trashed) != 0 {
+		t.Fatalf("过期用户仍在回收站: %v", trashed)
+	}
+	if fmt.Sprint(purged) != fmt.Sprint([]int{user.ID}) {
+		t.Fatalf("过期清理的回调为 %v", purged)
+	}
+}
+
+func TestDeleteKeepsUserWhenTrashSaveFails(t *testing.T) {
+	storage := &faultyStorage{MemoryStorage: NewMemoryStorage()}
+	m := NewMinimalManager(WithStorage(storage), WithAutoSave(true))
+	for _, name := range []string{"张三", "李四", "王五"} {
+		if _, err := m.AddUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage.metaErr = fmt.Errorf("磁盘已满")
+	if err := m.DeleteUser(1); err == nil {
+		t.Fatal("期望保存回收站失败")
+	}
+	if _, err := m.DeleteWhere(func(u User) bool { return u.ID == 2 }); err == nil {
+		t.Fatal("期望保存回收站失败")
+	}
+	if err := m.SaveToFile(); err == nil {
+		t.Fatal("期望保存回收站失败")
+	}
+
+	reloaded := NewMinimalManager(WithStorage(storage))
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1, 2} {
+		if _, ok := reloaded.GetUser(id); !ok {
+			t.Errorf("回收站保存失败后用户 %d 从存储中丢失", id)
+		}
+	}
+}
+
+func TestEventLogRecordsTrashAsEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	m := NewMinimalManager(WithStorage(NewEventLogStorage(path)), WithAutoSave(true))
+	for i := 0; i < 200; i++ {
+		user, err := m.AddUser(fmt.Sprintf("用户%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.DeleteUser(user.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.RestoreUser(7); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PurgeUser(8); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if len(line) > 200 {
+			t.Fatalf("日志行过长 (%d 字节): %.80s...", len(line), line)
+		}
+		if strings.Contains(line, `"type":"Meta"`) && strings.Contains(line, `"user"`) {
+			t.Fatalf("元数据记录不应包含用户: %s", line)
+		}
+	}
+
+	reloaded := NewMinimalManager(WithStorage(NewEventLogStorage(path)))
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(reloaded.ListTrashed()); n != 198 {
+		t.Fatalf("重建的回收站有 %d 个用户，期望 198", n)
+	}
+	if user, ok := reloaded.GetUser(7); !ok || user.Name != "用户6" {
+		t.Fatalf("恢复的用户为 %v, %v", user, ok)
+	}
+	if _, err := reloaded.RestoreUser(8); err == nil {
+		t.Fatal("彻底删除的用户不应能恢复")
+	}
+	if user, _ := reloaded.AddUser("新用户"); user.ID != 201 {
+		t.Fatalf("新用户ID为 %d，期望 201", user.ID)
+	}
+}
+
+func TestTxCommitIsAllOrNothing(t *testing.T) {
+	m := NewMinimalManager(
+		WithStorage(NewMemoryStorage()),
+		WithValidator(func(name string) error {
+			if name == "" {
+				return fmt.Errorf("姓名不能为空")
+			}
+			return nil
+		}),
+	)
+	existing, _ := m.AddUser("张三")
+
+	tests := []struct {
+		name  string
+		stage func(tx *Tx)
+	}{
+		{"无效姓名", func(tx *Tx) {
+			tx.AddUser("李四")
+			tx.DeleteUser(existing.ID)
+			tx.AddUser("")
+		}},
+		{"删除不存在的用户", func(tx *Tx) {
+			tx.AddUser("李四")
+			tx.DeleteUser(99)
+		}},
+		{"重复删除", func(tx *Tx) {
+			tx.AddUser("李四")
+			tx.DeleteUser(existing.ID)
+			tx.DeleteUser(existing.ID)
+		}},
+	}
+	for _, tt := range tests {
+		tx := m.Begin()
+		tt.stage(tx)
+		if added, err := tx.Commit(); err == nil || added != nil {
+			t.Errorf("%s: Commit 返回 %v, %v，期望失败", tt.name, added, err)
+		}
+		if users := m.ListUsers(SortByID, false); len(users) != 1 || users[0] != existing {
+			t.Errorf("%s: 失败的事务修改了数据: %v", tt.name, users)
+		}
+		if trashed := m.ListTrashed(); len(trashed) != 0 {
+			t.Errorf("%s: 失败的事务删除了用户: %v", tt.name, trashed)
+		}
+	}
+	if user, _ := m.AddUser("王五"); user.ID != existing.ID+1 {
+		t.Fatalf("失败的事务消耗了ID，新用户ID为 %d", user.ID)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	tx := m.Begin()
+	tx.AddUser("张三")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != errTxDone {
+		t.Fatalf("回滚后提交返回 %v，期望 errTxDone", err)
+	}
+	if err := tx.AddUser("李四"); err != errTxDone {
+		t.Fatalf("回滚后暂存返回 %v，期望 errTxDone", err)
+	}
+	if n := m.CountUsers(func(User) bool { return true }); n != 0 {
+		t.Fatalf("回滚后有 %d 个用户", n)
+	}
+
+	tx = m.Begin()
+	tx.AddUser("张三")
+	tx.AddUser("李四")
+	added, err := tx.Commit()
+	if err != nil || len(added) != 2 || added[0].ID != 1 || added[1].ID != 2 {
+		t.Fatalf("Commit 返回 %v, %v", added, err)
+	}
+	if err := tx.Rollback(); err != errTxDone {
+		t.Fatalf("提交后回滚返回 %v，期望 errTxDone", err)
+	}
+}
+
+func TestUpdateUserDetectsConflicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	m := NewMinimalManager(WithFilename(path), WithAutoSave(true))
+	user, _ := m.AddUser("张三")
+	if user.Version != 1 {
+		t.Fatalf("新用户版本为 %d，期望 1", user.Version)
+	}
+	updated, err := m.UpdateUser(user.ID, 1, "李四")
+	if err != nil || updated.Version != 2 || updated.Name != "李四" {
+		t.Fatalf("UpdateUser 返回 %v, %v", updated, err)
+	}
+	if _, err := m.UpdateUser(user.ID, 1, "王五"); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("使用旧版本修改返回 %v，期望版本冲突", err)
+	}
+	m.UpdateWhere(func(User) bool { return true }, func(u *User) { u.Name = "赵六"; u.Version = 100 })
+	if current, _ := m.GetUser(user.ID); current.Version != 3 {
+		t.Fatalf("UpdateWhere 后版本为 %d，期望 3", current.Version)
+	}
+
+	reloaded := NewMinimalManager(WithFilename(path))
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := reloaded.GetUser(user.ID); current.Version != 3 || current.Name != "赵六" {
+		t.Fatalf("重启后用户为 %v", current)
+	}
+}
+
+func TestFileStorageReadsV2Format(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	if err := ioutil.WriteFile(path, []byte("# users v2\n1,\"a,b\\n\"\n2,张三\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewFileStorage(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(users) != fmt.Sprint([]User{{1, "a,b\n", 1}, {2, "张三", 1}}) {
+		t.Fatalf("读取得到 %v", users)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	for _, name := range []string{"张三", "李四", "张伟", "王五", "张三丰", "李张"} {
+		m.AddUser(name)
+	}
+	tests := []struct {
+		name  string
+		query *Query
+		want  []int
+	}{
+		{"全部", m.Query(), []int{1, 2, 3, 4, 5, 6}},
+		{"姓名包含", m.Query().NameContains("张"), []int{1, 3, 5, 6}},
+		{"ID范围", m.Query().IDBetween(2, 4), []int{2, 3, 4}},
+		{"组合条件", m.Query().NameContains("张").IDBetween(2, 5), []int{3, 5}},
+		{"自定义条件", m.Query().Where(func(u User) bool { return u.ID%2 == 0 }), []int{2, 4, 6}},
+		{"按ID降序", m.Query().SortBy(SortByID, true).Limit(2), []int{6, 5}},
+		{"按姓名排序", m.Query().NameContains("张").SortBy(SortByName, false), []int{1, 5, 3, 6}},
+		{"限制数量", m.Query().Limit(3), []int{1, 2, 3}},
+		{"前几行被过滤时的限制", m.Query().IDBetween(4, 6).Limit(2), []int{4, 5}},
+		{"过滤后不足限制数量", m.Query().NameContains("李").Limit(5), []int{2, 6}},
+		{"无匹配", m.Query().NameContains("赵"), nil},
+	}
+	for _, tt := range tests {
+		var ids []int
+		for _, user := range tt.query.Run() {
+			ids = append(ids, user.ID)
+		}
+		if fmt.Sprint(ids) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: 得到 %v，期望 %v", tt.name, ids, tt.want)
+		}
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	m := NewMinimalManager(WithStorage(NewMemoryStorage()))
+	for _, name := range []string{"张三", "李四", "张伟"} {
+		m.AddUser(name)
+	}
+	n := m.CountUsers(func(u User) bool {
+		m.GetUser(u.ID) // predicate 在锁外调用，可以回调管理器
+		return strings.HasPrefix(u.Name, "张")
+	})
+	if n != 2 {
+		t.Fatalf("CountUsers 得到 %d，期望 2", n)
+	}
+}